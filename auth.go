@@ -0,0 +1,138 @@
+package discovery
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	nonceSize = 12
+	macSize   = sha256.Size
+	// envelopeOverhead is the number of bytes Sign adds around the caller's
+	// payload: a nonce, a timestamp and a trailing HMAC.
+	envelopeOverhead = nonceSize + 8 + macSize
+	// defaultReplayCacheSize bounds the number of (source, nonce) pairs an
+	// HMACAuthenticator remembers, so a long-running Discover can't be made
+	// to grow its replay cache without bound.
+	defaultReplayCacheSize = 4096
+	// defaultAuthSkew is the clock skew tolerance used when Options.PSK is
+	// set without an explicit Authenticator.
+	defaultAuthSkew = 5 * time.Second
+)
+
+// Authenticator authenticates broadcast payloads and protects Discover
+// against spoofed or replayed packets. Sign wraps an outgoing payload in an
+// authenticated envelope; Verify checks an incoming envelope and, on
+// success, returns the original payload.
+type Authenticator interface {
+	Sign(payload []byte) ([]byte, error)
+	Verify(src net.Addr, envelope []byte) (payload []byte, ok bool)
+}
+
+// HMACAuthenticator authenticates broadcasts with a pre-shared key. Each
+// envelope is nonce || timestamp || payload || HMAC-SHA256(psk, nonce ||
+// timestamp || payload). Verify rejects envelopes with a bad MAC, a
+// timestamp more than skew away from now (when skew > 0), or a (source,
+// nonce) pair it has already seen.
+type HMACAuthenticator struct {
+	psk  []byte
+	skew time.Duration
+
+	mu    sync.Mutex
+	seen  map[string]struct{}
+	order []string
+	cap   int
+}
+
+// NewHMACAuthenticator creates an Authenticator that signs and verifies
+// payloads with psk, rejecting any envelope whose timestamp is more than
+// skew away from the local clock. A skew of zero or less disables the
+// timestamp check.
+func NewHMACAuthenticator(psk []byte, skew time.Duration) *HMACAuthenticator {
+	return &HMACAuthenticator{
+		psk:  psk,
+		skew: skew,
+		seen: make(map[string]struct{}),
+		cap:  defaultReplayCacheSize,
+	}
+}
+
+// Sign wraps payload in a fresh nonce and the current timestamp, and
+// appends an HMAC-SHA256 over all three.
+func (a *HMACAuthenticator) Sign(payload []byte) ([]byte, error) {
+	envelope := make([]byte, nonceSize+8, envelopeOverhead+len(payload))
+	if _, err := rand.Read(envelope[:nonceSize]); err != nil {
+		return nil, fmt.Errorf("discovery: generating nonce: %w", err)
+	}
+	binary.BigEndian.PutUint64(envelope[nonceSize:nonceSize+8], uint64(time.Now().Unix()))
+	envelope = append(envelope, payload...)
+
+	mac := hmac.New(sha256.New, a.psk)
+	mac.Write(envelope)
+	return mac.Sum(envelope), nil
+}
+
+// Verify checks envelope's MAC and timestamp, and rejects a (src, nonce)
+// pair it has already seen. On success it returns the payload that was
+// passed to Sign.
+func (a *HMACAuthenticator) Verify(src net.Addr, envelope []byte) ([]byte, bool) {
+	if len(envelope) < envelopeOverhead {
+		return nil, false
+	}
+
+	body := envelope[:len(envelope)-macSize]
+	wantMAC := envelope[len(envelope)-macSize:]
+
+	mac := hmac.New(sha256.New, a.psk)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), wantMAC) {
+		return nil, false
+	}
+
+	nonce := body[:nonceSize]
+	ts := int64(binary.BigEndian.Uint64(body[nonceSize : nonceSize+8]))
+	if a.skew > 0 {
+		skew := time.Since(time.Unix(ts, 0))
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > a.skew {
+			return nil, false
+		}
+	}
+
+	if a.seenBefore(src, nonce) {
+		return nil, false
+	}
+
+	return body[nonceSize+8:], true
+}
+
+// seenBefore reports whether (src, nonce) has already been verified,
+// recording it if not. The cache is bounded to cap entries, evicting the
+// oldest on overflow.
+func (a *HMACAuthenticator) seenBefore(src net.Addr, nonce []byte) bool {
+	key := src.String() + string(nonce)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.seen[key]; ok {
+		return true
+	}
+
+	a.seen[key] = struct{}{}
+	a.order = append(a.order, key)
+	if len(a.order) > a.cap {
+		oldest := a.order[0]
+		a.order = a.order[1:]
+		delete(a.seen, oldest)
+	}
+	return false
+}
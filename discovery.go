@@ -1,6 +1,7 @@
 package discovery
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
@@ -10,13 +11,39 @@ import (
 	"time"
 )
 
+// IPVersion is a bitmask of Internet Protocol families. IPv4 and IPv6 may
+// be combined (DualStack) to run both families concurrently.
 type IPVersion uint
 
 const (
-	IPv4 IPVersion = 4
-	IPv6 IPVersion = 6
+	IPv4 IPVersion = 1 << iota
+	IPv6
+
+	// DualStack runs IPv4 and IPv6 sockets concurrently and merges their
+	// discovered peers into a single stream.
+	DualStack = IPv4 | IPv6
 )
 
+// families returns the individual families set in v, in a stable order.
+func (v IPVersion) families() []IPVersion {
+	var fs []IPVersion
+	if v&IPv4 != 0 {
+		fs = append(fs, IPv4)
+	}
+	if v&IPv6 != 0 {
+		fs = append(fs, IPv6)
+	}
+	return fs
+}
+
+// network returns the net.ListenPacket network name for a single family.
+func (v IPVersion) network() string {
+	if v == IPv4 {
+		return "udp4"
+	}
+	return "udp6"
+}
+
 type Options struct {
 	// Limit is the number of to discover (default 1)
 	Limit int
@@ -36,6 +63,25 @@ type Options struct {
 	// You should be able to use any of 224.0.0.0/4 or ff00::/8.
 	// default address (239.255.255.250 for IPv4 or ff02::c for IPv6).
 	MulticastAddress string
+	// Interfaces selects and orders the interfaces joined for broadcasting
+	// and discovery. The zero value joins every up, broadcast-capable
+	// interface.
+	Interfaces InterfacePolicy
+	// OnPacket, if set, decides whether a received datagram identifies a
+	// peer worth reporting. It is called from Discover.Scan for every
+	// datagram read, with the source address, the raw payload and the
+	// interface it arrived on. When nil, Scan falls back to checking that the
+	// payload begins with Payload, byte-for-byte; trailing bytes are ignored.
+	OnPacket func(src net.Addr, payload []byte, iface *net.Interface) bool
+	// PSK, if set, enables authenticated broadcasts: Payload is wrapped in
+	// an HMAC-SHA256 envelope with a fresh nonce and timestamp on send, and
+	// Discover rejects any packet whose envelope doesn't verify. Ignored if
+	// Authenticator is set explicitly.
+	PSK []byte
+	// Authenticator, if set, authenticates broadcasts and rejects spoofed
+	// or replayed discover packets. Set automatically from PSK when PSK is
+	// non-nil and Authenticator is nil; see NewHMACAuthenticator.
+	Authenticator Authenticator
 
 	payloadLen int
 }
@@ -44,7 +90,13 @@ type NetPacketConn interface {
 	JoinGroup(ifi *net.Interface, group net.Addr) error
 	SetMulticastInterface(ini *net.Interface) error
 	SetMulticastTTL(int) error
-	ReadFrom(buf []byte) (int, net.Addr, error)
+	// SetControlMessage(true) makes ReadFrom report the inbound interface
+	// index via ifIndex; it is a no-op to request it more than once.
+	SetControlMessage(on bool) error
+	// ReadFrom returns, in addition to the datagram and its source, the
+	// index of the interface it arrived on (-1 if unknown or not
+	// requested via SetControlMessage).
+	ReadFrom(buf []byte) (n int, src net.Addr, ifIndex int, err error)
 	WriteTo(buf []byte, dst net.Addr) (int, error)
 }
 
@@ -52,9 +104,17 @@ type IPv4PacketConn struct {
 	*ipv4.PacketConn
 }
 
-func (ip4 IPv4PacketConn) ReadFrom(buf []byte) (int, net.Addr, error) {
-	n, _, addr, err := ip4.PacketConn.ReadFrom(buf)
-	return n, addr, err
+func (ip4 IPv4PacketConn) SetControlMessage(on bool) error {
+	return ip4.PacketConn.SetControlMessage(ipv4.FlagInterface, on)
+}
+
+func (ip4 IPv4PacketConn) ReadFrom(buf []byte) (int, net.Addr, int, error) {
+	n, cm, addr, err := ip4.PacketConn.ReadFrom(buf)
+	ifIndex := -1
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return n, addr, ifIndex, err
 }
 
 func (ip4 IPv4PacketConn) WriteTo(buf []byte, dst net.Addr) (int, error) {
@@ -65,9 +125,17 @@ type IPv6PacketConn struct {
 	*ipv6.PacketConn
 }
 
-func (ip6 IPv6PacketConn) ReadFrom(buf []byte) (int, net.Addr, error) {
-	n, _, addr, err := ip6.PacketConn.ReadFrom(buf)
-	return n, addr, err
+func (ip6 IPv6PacketConn) SetControlMessage(on bool) error {
+	return ip6.PacketConn.SetControlMessage(ipv6.FlagInterface, on)
+}
+
+func (ip6 IPv6PacketConn) ReadFrom(buf []byte) (int, net.Addr, int, error) {
+	n, cm, addr, err := ip6.PacketConn.ReadFrom(buf)
+	ifIndex := -1
+	if cm != nil {
+		ifIndex = cm.IfIndex
+	}
+	return n, addr, ifIndex, err
 }
 
 func (ip6 IPv6PacketConn) WriteTo(buf []byte, dst net.Addr) (int, error) {
@@ -80,18 +148,34 @@ func (ip6 IPv6PacketConn) SetMulticastTTL(i int) error {
 
 type Broadcast struct {
 	Options *Options
-	quit    chan bool
+	*lifecycle
 }
 
 type Discover struct {
 	sync.RWMutex
 	Options  *Options
 	received map[string]byte
-	done     chan bool
+	*lifecycle
 }
 
 type Discovered struct {
 	Address string
+	// IPVersion is the address family (IPv4 or IPv6) the peer was seen on.
+	// Only meaningful when Options.IPVersion is DualStack; otherwise it
+	// always matches the single configured family.
+	IPVersion IPVersion
+	// Host, Port and TXT are populated by discovery backends that resolve
+	// structured records, such as mDNS/DNS-SD (see NewMDNSDiscover). They
+	// are left empty by the plain UDP payload-matching backend.
+	Host string
+	Port int
+	TXT  map[string]string
+	// Iface is the name of the local interface the peer's datagram arrived
+	// on, and LocalAddr is that interface's own address in the same
+	// family, letting callers distinguish the same peer seen on multiple
+	// interfaces (e.g. eth0 vs. wlan0).
+	Iface     string
+	LocalAddr net.IP
 }
 
 // initOptions set default options
@@ -117,194 +201,356 @@ func initOptions(options *Options) {
 	if options.Port == "" {
 		options.Port = "9081"
 	}
-	if options.MulticastAddress == "" {
-		if options.IPVersion == IPv4 {
-			options.MulticastAddress = "239.255.255.250"
-		} else {
-			options.MulticastAddress = "ff02::c"
-		}
+	if options.Authenticator == nil && options.PSK != nil {
+		options.Authenticator = NewHMACAuthenticator(options.PSK, defaultAuthSkew)
 	}
 
 	options.payloadLen = len(options.Payload)
 }
 
-func (b *Broadcast) StartBroadcast() error {
-	initOptions(b.Options)
+// multicastAddress returns the multicast group to use for a single family.
+// Options.MulticastAddress only applies when IPVersion selects that single
+// family; DualStack always uses the per-family defaults, since one address
+// can't name both an IPv4 and an IPv6 group.
+func (options *Options) multicastAddress(version IPVersion) string {
+	if options.MulticastAddress != "" && options.IPVersion == version {
+		return options.MulticastAddress
+	}
+	if version == IPv4 {
+		return "239.255.255.250"
+	}
+	return "ff02::c"
+}
 
-	ifaces, err := FilterInterfaces(b.Options.IPVersion == IPv4)
+// familyConn is one family's (IPv4 or IPv6) joined multicast socket.
+type familyConn struct {
+	version IPVersion
+	pc      net.PacketConn
+	npc     NetPacketConn
+	group   net.IP
+	port    int
+	ifaces  []*net.Interface
+}
+
+// iface returns the interface ifIndex was read from, or nil if it doesn't
+// match any interface this conn joined the group on.
+func (fc *familyConn) iface(ifIndex int) *net.Interface {
+	for _, ifc := range fc.ifaces {
+		if ifc.Index == ifIndex {
+			return ifc
+		}
+	}
+	return nil
+}
+
+// localAddr returns ifc's own address in fc's family, if any.
+func (fc *familyConn) localAddr(ifc *net.Interface) net.IP {
+	if ifc == nil {
+		return nil
+	}
+	addrs, err := ifc.Addrs()
 	if err != nil {
-		return err
+		return nil
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP == nil {
+			continue
+		}
+		if (ipNet.IP.To4() != nil) == (fc.version == IPv4) {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+func openFamilyConn(version IPVersion, options *Options, withControlMessage bool) (*familyConn, error) {
+	ifaces, err := FilterInterfaces(version, options.Interfaces)
+	if err != nil {
+		return nil, err
 	}
 	if len(ifaces) == 0 {
-		return fmt.Errorf("no multicast interface found")
+		return nil, fmt.Errorf("no multicast interface found for %s", version.network())
 	}
 
-	address := net.JoinHostPort(b.Options.MulticastAddress, b.Options.Port)
+	maddr := options.multicastAddress(version)
+	address := net.JoinHostPort(maddr, options.Port)
 
-	c, err := net.ListenPacket(fmt.Sprintf("udp%d", b.Options.IPVersion), address)
+	pc, err := net.ListenPacket(version.network(), address)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer c.Close()
 
-	group := net.ParseIP(b.Options.MulticastAddress)
-	port, err := strconv.Atoi(b.Options.Port)
+	group := net.ParseIP(maddr)
+	port, err := strconv.Atoi(options.Port)
 	if err != nil {
-		return err
+		pc.Close()
+		return nil, err
 	}
+
 	var npc NetPacketConn
-	if b.Options.IPVersion == IPv4 {
-		npc = IPv4PacketConn{ipv4.NewPacketConn(c)}
+	if version == IPv4 {
+		npc = IPv4PacketConn{ipv4.NewPacketConn(pc)}
 	} else {
-		npc = IPv6PacketConn{ipv6.NewPacketConn(c)}
+		npc = IPv6PacketConn{ipv6.NewPacketConn(pc)}
+	}
+	if withControlMessage {
+		if err := npc.SetControlMessage(true); err != nil {
+			fmt.Println(err)
+		}
 	}
-
 	for i := range ifaces {
-		err := npc.JoinGroup(ifaces[i], &net.UDPAddr{IP: group, Port: port})
-		if err != nil {
+		if err := npc.JoinGroup(ifaces[i], &net.UDPAddr{IP: group, Port: port}); err != nil {
 			fmt.Println(err)
 		}
 	}
 
-	ticker := time.NewTicker(b.Options.BroadcastDelay)
+	return &familyConn{version: version, pc: pc, npc: npc, group: group, port: port, ifaces: ifaces}, nil
+}
+
+func (fc *familyConn) Close() error {
+	return fc.pc.Close()
+}
+
+// openFamilyConns opens a familyConn for every family in version (IPv4,
+// IPv6, or both for DualStack), closing any already-opened conns if a
+// later one fails. withControlMessage requests per-datagram inbound
+// interface attribution (see familyConn.iface); broadcasting doesn't need
+// it.
+func openFamilyConns(version IPVersion, options *Options, withControlMessage bool) ([]*familyConn, error) {
+	families := version.families()
+	conns := make([]*familyConn, 0, len(families))
+	for _, v := range families {
+		fc, err := openFamilyConn(v, options, withControlMessage)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, fc)
+	}
+	return conns, nil
+}
+
+// Run joins the broadcast multicast group(s) and sends Options.Payload
+// every Options.BroadcastDelay until ctx is done, Options.Duration elapses,
+// or Close is called. It owns the goroutines and sockets it starts and
+// closes all of them before returning.
+func (b *Broadcast) Run(ctx context.Context) error {
+	initOptions(b.Options)
+
+	conns, err := openFamilyConns(b.Options.IPVersion, b.Options, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, fc := range conns {
+			fc.Close()
+		}
+	}()
+
+	ctx, cancel := b.merge(ctx)
+	defer cancel()
 
 	if b.Options.Duration > 0 {
 		go func() {
-			time.AfterFunc(b.Options.Duration, func() {
-				b.quit <- true
-			})
+			timer := time.NewTimer(b.Options.Duration)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+				b.Close()
+			case <-ctx.Done():
+			}
 		}()
 	}
-LOOP:
+
+	ticker := time.NewTicker(b.Options.BroadcastDelay)
+	defer ticker.Stop()
+
 	for {
 		select {
-		case <-b.quit:
-			break LOOP
+		case <-ctx.Done():
+			return nil
 		case <-ticker.C:
-			for i := range ifaces {
-				if errMulticast := npc.SetMulticastInterface(ifaces[i]); errMulticast != nil {
+			payload := b.Options.Payload
+			if b.Options.Authenticator != nil {
+				signed, err := b.Options.Authenticator.Sign(b.Options.Payload)
+				if err != nil {
+					fmt.Println(err)
 					continue
 				}
-				_ = npc.SetMulticastTTL(2)
-				if _, errMulticast := npc.WriteTo(b.Options.Payload, &net.UDPAddr{IP: group, Port: port}); errMulticast != nil {
-					continue
+				payload = signed
+			}
+			for _, fc := range conns {
+				for i := range fc.ifaces {
+					if errMulticast := fc.npc.SetMulticastInterface(fc.ifaces[i]); errMulticast != nil {
+						continue
+					}
+					_ = fc.npc.SetMulticastTTL(2)
+					if _, errMulticast := fc.npc.WriteTo(payload, &net.UDPAddr{IP: fc.group, Port: fc.port}); errMulticast != nil {
+						continue
+					}
 				}
 			}
 		}
 	}
-	return nil
 }
 
-func (b *Broadcast) StartAsSync() {
-	go b.StartBroadcast()
+// RunAsync runs Run in a new goroutine.
+func (b *Broadcast) RunAsync(ctx context.Context) {
+	go b.Run(ctx)
 }
 
-func (b *Broadcast) StopBroadcast() {
-	b.quit <- true
-}
-
-func (d *Discover) DiscoverBroadcast() ([]*Discovered, error) {
+// Scan joins the discovery multicast group(s) and streams each newly seen
+// peer on the returned channel as its datagram arrives. When Options.IPVersion
+// is DualStack, an IPv4 and an IPv6 socket are run concurrently and merged
+// into one stream, with each Discovered tagged by the family it arrived on.
+// The channel is closed when ctx is done, when Close is called, when
+// Options.TimeLimit elapses, or once Options.Limit distinct peers have
+// been reported.
+func (d *Discover) Scan(ctx context.Context) (<-chan *Discovered, error) {
 	initOptions(d.Options)
 
-	ds := make([]*Discovered, 0)
-
-	err := d.receive()
+	conns, err := openFamilyConns(d.Options.IPVersion, d.Options, true)
 	if err != nil {
 		return nil, err
 	}
 
-	for host := range d.received {
-		ds = append(ds, &Discovered{host})
+	ctx, cancel := d.merge(ctx)
+	timeoutCancel := func() {}
+	if d.Options.TimeLimit > 0 {
+		ctx, timeoutCancel = context.WithTimeout(ctx, d.Options.TimeLimit)
 	}
 
-	return ds, nil
-}
-
-func (d *Discover) receive() error {
-	ifaces, err := FilterInterfaces(d.Options.IPVersion == IPv4)
-	if err != nil {
-		return err
-	}
-	if len(ifaces) == 0 {
-		fmt.Println("no multicast interface found")
-		return err
-	}
-
-	address := net.JoinHostPort(d.Options.MulticastAddress, d.Options.Port)
-
-	c, err := net.ListenPacket(fmt.Sprintf("udp%d", d.Options.IPVersion), address)
-	if err != nil {
-		return err
-	}
-	defer c.Close()
-
-	group := net.ParseIP(d.Options.MulticastAddress)
-	port, err := strconv.Atoi(d.Options.Port)
-	if err != nil {
-		return err
+	// limitCtx is cancelled the moment any family's scan reports
+	// Options.Limit distinct peers, so the other families' read loops stop
+	// promptly instead of blocking on ReadFrom until ctx/TimeLimit fires.
+	limitCtx, stopOnLimit := context.WithCancel(ctx)
+
+	out := make(chan *Discovered)
+	var wg sync.WaitGroup
+	wg.Add(len(conns))
+	for _, fc := range conns {
+		go func(fc *familyConn) {
+			defer wg.Done()
+			defer fc.Close()
+			d.scan(limitCtx, fc, out, stopOnLimit)
+		}(fc)
 	}
+	go func() {
+		wg.Wait()
+		stopOnLimit()
+		timeoutCancel()
+		cancel()
+		close(out)
+	}()
 
-	var npc NetPacketConn
-	if d.Options.IPVersion == IPv4 {
-		npc = IPv4PacketConn{ipv4.NewPacketConn(c)}
-	} else {
-		npc = IPv6PacketConn{ipv6.NewPacketConn(c)}
-	}
-	for i := range ifaces {
-		err := npc.JoinGroup(ifaces[i], &net.UDPAddr{IP: group, Port: port})
-		if err != nil {
-			//return  nil, err
-		}
-	}
+	return out, nil
+}
 
-	time.AfterFunc(d.Options.TimeLimit, func() {
-		d.done <- true
-	})
+type discoverPacket struct {
+	payload []byte
+	src     net.Addr
+	ifIndex int
+}
 
+// scan runs the persistent read loop for a single family's socket, feeding
+// newly seen peers into the shared out channel until ctx is done or
+// Options.Limit is reached. stopOnLimit is called once Limit distinct peers
+// have been seen across all families, so sibling scans for other families
+// stop promptly instead of blocking on ReadFrom until ctx/TimeLimit fires.
+func (d *Discover) scan(ctx context.Context, fc *familyConn, out chan<- *Discovered, stopOnLimit context.CancelFunc) {
+	packets := make(chan discoverPacket)
 	go func() {
-		var buf [66507]byte
-		n, src, err := npc.ReadFrom(buf[:])
-		if err != nil {
-			fmt.Println(err)
+		buf := make([]byte, 66507)
+		for {
+			n, src, ifIndex, err := fc.npc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			payload := make([]byte, n)
+			copy(payload, buf[:n])
+			select {
+			case packets <- discoverPacket{payload: payload, src: src, ifIndex: ifIndex}:
+			case <-ctx.Done():
+				return
+			}
 		}
-		if n > 0 && string(d.Options.Payload) == string(buf[:d.Options.payloadLen]) {
-			srcHost, _, _ := net.SplitHostPort(src.String())
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-packets:
+			ifc := fc.iface(p.ifIndex)
+			if !d.accept(p, ifc) {
+				continue
+			}
+			srcHost, _, _ := net.SplitHostPort(p.src.String())
 			d.Lock()
-			if _, ok := d.received[srcHost]; !ok {
+			_, seen := d.received[srcHost]
+			if !seen {
 				d.received[srcHost] = byte('0')
 			}
+			count := len(d.received)
 			d.Unlock()
+			if seen {
+				continue
+			}
 
-			if d.Options.Limit > 0 {
-				if d.Options.Limit == len(d.received) {
-					d.done <- true
-				}
+			discovered := &Discovered{Address: srcHost, IPVersion: fc.version}
+			if ifc != nil {
+				discovered.Iface = ifc.Name
+				discovered.LocalAddr = fc.localAddr(ifc)
+			}
+			select {
+			case out <- discovered:
+			case <-ctx.Done():
+				return
+			}
+
+			if d.Options.Limit > 0 && count >= d.Options.Limit {
+				stopOnLimit()
+				return
 			}
 		}
-	}()
+	}
+}
 
-LOOP:
-	for {
-		select {
-		case <-d.done:
-			break LOOP
-		default:
+// accept decides whether p identifies a peer. If Options.Authenticator is
+// set, the envelope must verify before the unwrapped payload is considered
+// at all. The unwrapped payload is then passed to Options.OnPacket when
+// set; otherwise it must begin with Options.Payload, byte-for-byte, and any
+// bytes after that prefix are ignored.
+func (d *Discover) accept(p discoverPacket, ifc *net.Interface) bool {
+	payload := p.payload
+	if d.Options.Authenticator != nil {
+		verified, ok := d.Options.Authenticator.Verify(p.src, payload)
+		if !ok {
+			return false
 		}
+		payload = verified
+	}
+	if d.Options.OnPacket != nil {
+		return d.Options.OnPacket(p.src, payload, ifc)
 	}
-	return err
+	return len(payload) >= d.Options.payloadLen &&
+		string(d.Options.Payload) == string(payload[:d.Options.payloadLen])
 }
 
 func NewBroadcast(options *Options) *Broadcast {
 	return &Broadcast{
-		Options: options,
-		quit:    make(chan bool),
+		Options:   options,
+		lifecycle: newLifecycle(),
 	}
 }
 
 func NewDiscover(options *Options) *Discover {
 	return &Discover{
-		Options:  options,
-		received: make(map[string]byte, 0),
-		done:     make(chan bool, 1),
+		Options:   options,
+		received:  make(map[string]byte, 0),
+		lifecycle: newLifecycle(),
 	}
 }
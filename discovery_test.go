@@ -0,0 +1,69 @@
+package discovery
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestBroadcastClose proves Close is idempotent: calling it twice, or while
+// Run is in flight, must not panic or deadlock, and Run must return.
+func TestBroadcastClose(t *testing.T) {
+	b := NewBroadcast(&Options{
+		MulticastAddress: "239.255.255.250",
+		Port:             "19082",
+		BroadcastDelay:   5 * time.Millisecond,
+		Interfaces:       InterfacePolicy{SkipPointToPoint: true},
+	})
+
+	done := make(chan error, 1)
+	go func() { done <- b.Run(context.Background()) }()
+
+	time.Sleep(20 * time.Millisecond)
+	b.Close()
+	b.Close() // must not panic or block
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Skipf("no usable multicast interface in this environment: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+}
+
+// TestDiscoverScanNoGoroutineLeak runs Scan to completion 1000 times and
+// checks the goroutine count settles back down, guarding against the
+// read-loop and wait goroutines started by Scan outliving the channel they
+// feed.
+func TestDiscoverScanNoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 1000; i++ {
+		d := NewDiscover(&Options{
+			MulticastAddress: "239.255.255.250",
+			Port:             "19083",
+			TimeLimit:        5 * time.Millisecond,
+			Interfaces:       InterfacePolicy{SkipPointToPoint: true},
+		})
+
+		out, err := d.Scan(context.Background())
+		if err != nil {
+			t.Skipf("no usable multicast interface in this environment: %v", err)
+		}
+		for range out {
+			// drain until Scan closes it at TimeLimit
+		}
+		d.Close()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	runtime.GC()
+
+	after := runtime.NumGoroutine()
+	if after > before+5 {
+		t.Fatalf("goroutine leak across Scan cycles: started with %d, ended with %d", before, after)
+	}
+}
@@ -0,0 +1,43 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+)
+
+// lifecycle gives Broadcast and Discover an internal context that Close
+// cancels exactly once, however many times Close is called or from however
+// many goroutines. Embedding it gives a type an idempotent Close() for free.
+type lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &lifecycle{ctx: ctx, cancel: cancel}
+}
+
+// Close cancels the lifecycle's internal context, causing any Run/Scan
+// loops using it to return. Safe to call more than once, and from more
+// than one goroutine; only the first call has an effect.
+func (l *lifecycle) Close() error {
+	l.once.Do(l.cancel)
+	return nil
+}
+
+// merge returns a context done when either ctx or l is closed, and a
+// cancel func the caller must invoke once that context is no longer
+// needed, to release the goroutine backing the merge.
+func (l *lifecycle) merge(ctx context.Context) (context.Context, context.CancelFunc) {
+	merged, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-l.ctx.Done():
+			cancel()
+		case <-merged.Done():
+		}
+	}()
+	return merged, cancel
+}
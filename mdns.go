@@ -0,0 +1,447 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/yunis-du/discovery/mdns"
+)
+
+const (
+	// mdnsIPv4Address is the standard mDNS IPv4 multicast group (RFC 6762 §3).
+	mdnsIPv4Address = "224.0.0.251"
+	// mdnsIPv6Address is the standard mDNS IPv6 multicast group (RFC 6762 §3).
+	mdnsIPv6Address = "ff02::fb"
+	// mdnsPort is the standard mDNS port (RFC 6762 §3).
+	mdnsPort = "5353"
+	// mdnsTTL is the TTL used for mDNS resource records.
+	mdnsTTL = 120
+)
+
+// ServiceInfo describes a service advertised or looked up over mDNS/DNS-SD.
+type ServiceInfo struct {
+	// Instance is the service instance name, e.g. "my-node".
+	Instance string
+	// Service is the DNS-SD service type, e.g. "_myapp._udp".
+	Service string
+	// Domain is the discovery domain. Defaults to "local".
+	Domain string
+	// Host is the hostname advertised in the SRV/A/AAAA records. Defaults
+	// to the machine hostname.
+	Host string
+	// Port is the service port advertised in the SRV record.
+	Port int
+	// IPs are the addresses advertised in A/AAAA records. If empty, the
+	// local interface addresses are used.
+	IPs []net.IP
+	// TXT holds the key/value pairs advertised in the TXT record.
+	TXT map[string]string
+}
+
+func (s *ServiceInfo) init() error {
+	if s.Service == "" {
+		return fmt.Errorf("mdns: ServiceInfo.Service is required")
+	}
+	if s.Domain == "" {
+		s.Domain = "local"
+	}
+	if s.Host == "" {
+		s.Host, _ = os.Hostname()
+	}
+	return nil
+}
+
+// serviceFQDN is the PTR query name for the service, e.g. "_myapp._udp.local.".
+func (s *ServiceInfo) serviceFQDN() string {
+	return s.Service + "." + s.Domain + "."
+}
+
+// instanceFQDN is the SRV/TXT record name for this instance, e.g.
+// "my-node._myapp._udp.local.".
+func (s *ServiceInfo) instanceFQDN() string {
+	return s.Instance + "." + s.serviceFQDN()
+}
+
+// hostFQDN is the A/AAAA record name for this instance's host.
+func (s *ServiceInfo) hostFQDN() string {
+	return s.Host + "." + s.Domain + "."
+}
+
+// mdnsConn is one address family's joined mDNS multicast socket, analogous
+// to familyConn in discovery.go but bound to the fixed mDNS group addresses
+// and port rather than Options.
+type mdnsConn struct {
+	version IPVersion
+	pc      net.PacketConn
+	npc     NetPacketConn
+	group   net.IP
+	port    int
+}
+
+func (mc *mdnsConn) Close() error {
+	return mc.pc.Close()
+}
+
+// openMDNSConn joins the mDNS multicast group for a single family on every
+// interface matching policy.
+func openMDNSConn(version IPVersion, policy InterfacePolicy) (*mdnsConn, error) {
+	ifaces, err := FilterInterfaces(version, policy)
+	if err != nil {
+		return nil, err
+	}
+	if len(ifaces) == 0 {
+		return nil, fmt.Errorf("no multicast interface found for %s", version.network())
+	}
+
+	pc, err := net.ListenPacket(version.network(), net.JoinHostPort("", mdnsPort))
+	if err != nil {
+		return nil, err
+	}
+
+	address := mdnsIPv4Address
+	if version == IPv6 {
+		address = mdnsIPv6Address
+	}
+	group := net.ParseIP(address)
+	port, _ := strconv.Atoi(mdnsPort)
+
+	var npc NetPacketConn
+	if version == IPv4 {
+		npc = IPv4PacketConn{ipv4.NewPacketConn(pc)}
+	} else {
+		npc = IPv6PacketConn{ipv6.NewPacketConn(pc)}
+	}
+	for i := range ifaces {
+		if err := npc.JoinGroup(ifaces[i], &net.UDPAddr{IP: group, Port: port}); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	return &mdnsConn{version: version, pc: pc, npc: npc, group: group, port: port}, nil
+}
+
+// openMDNSConns joins the mDNS multicast group on both IPv4 and IPv6, so
+// responders/queriers interoperate with dual-stack implementations like
+// Avahi and Bonjour. It closes any already-opened conn if a later one
+// fails.
+func openMDNSConns(policy InterfacePolicy) ([]*mdnsConn, error) {
+	conns := make([]*mdnsConn, 0, len(DualStack.families()))
+	for _, v := range DualStack.families() {
+		mc, err := openMDNSConn(v, policy)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, mc)
+	}
+	return conns, nil
+}
+
+// MDNSBroadcast answers mDNS/DNS-SD queries for a single ServiceInfo.
+type MDNSBroadcast struct {
+	Service *ServiceInfo
+	*lifecycle
+}
+
+// NewMDNSBroadcast creates an MDNSBroadcast that will answer PTR/SRV/TXT/A/AAAA
+// queries for service.
+func NewMDNSBroadcast(service ServiceInfo) *MDNSBroadcast {
+	return &MDNSBroadcast{
+		Service:   &service,
+		lifecycle: newLifecycle(),
+	}
+}
+
+func (b *MDNSBroadcast) records() ([]mdns.ResourceRecord, error) {
+	s := b.Service
+	ips := s.IPs
+	if len(ips) == 0 {
+		for ip := range GetLocalIPs() {
+			if parsed := net.ParseIP(ip); parsed != nil && !parsed.IsLoopback() {
+				ips = append(ips, parsed)
+			}
+		}
+	}
+
+	var rrs []mdns.ResourceRecord
+	rrs = append(rrs, mdns.ResourceRecord{
+		Name: s.serviceFQDN(), Type: mdns.TypePTR, Class: mdns.ClassINET, TTL: mdnsTTL,
+		Data: mdns.EncodePTR(s.instanceFQDN()),
+	})
+	rrs = append(rrs, mdns.ResourceRecord{
+		Name: s.instanceFQDN(), Type: mdns.TypeSRV, Class: mdns.ClassINET, CacheFlush: true, TTL: mdnsTTL,
+		Data: mdns.EncodeSRV(mdns.SRV{Port: uint16(s.Port), Target: s.hostFQDN()}),
+	})
+	rrs = append(rrs, mdns.ResourceRecord{
+		Name: s.instanceFQDN(), Type: mdns.TypeTXT, Class: mdns.ClassINET, CacheFlush: true, TTL: mdnsTTL,
+		Data: mdns.EncodeTXT(s.TXT),
+	})
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			rrs = append(rrs, mdns.ResourceRecord{
+				Name: s.hostFQDN(), Type: mdns.TypeA, Class: mdns.ClassINET, CacheFlush: true, TTL: mdnsTTL,
+				Data: mdns.EncodeA(v4),
+			})
+		} else {
+			rrs = append(rrs, mdns.ResourceRecord{
+				Name: s.hostFQDN(), Type: mdns.TypeAAAA, Class: mdns.ClassINET, CacheFlush: true, TTL: mdnsTTL,
+				Data: mdns.EncodeAAAA(ip),
+			})
+		}
+	}
+	return rrs, nil
+}
+
+// Run listens for mDNS queries on both IPv4 and IPv6 and answers any that
+// match the advertised service, until ctx is done or Close is called.
+func (b *MDNSBroadcast) Run(ctx context.Context) error {
+	if err := b.Service.init(); err != nil {
+		return err
+	}
+
+	conns, err := openMDNSConns(InterfacePolicy{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, mc := range conns {
+			mc.Close()
+		}
+	}()
+
+	rrs, err := b.records()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := b.merge(ctx)
+	defer cancel()
+
+	type queryResult struct {
+		msg *mdns.Message
+		src net.Addr
+		mc  *mdnsConn
+	}
+	queries := make(chan queryResult, 8)
+
+	for i := range conns {
+		mc := conns[i]
+		go func() {
+			var buf [66507]byte
+			for {
+				n, src, _, err := mc.npc.ReadFrom(buf[:])
+				if err != nil {
+					return
+				}
+				msg, err := mdns.Unpack(buf[:n])
+				if err != nil || msg.IsResponse() {
+					continue
+				}
+				select {
+				case queries <- queryResult{msg: msg, src: src, mc: mc}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case q := <-queries:
+			var answers []mdns.ResourceRecord
+			unicast := false
+			for _, question := range q.msg.Questions {
+				if question.UnicastResponse {
+					unicast = true
+				}
+				// A PTR question for the service is answered with the whole
+				// record set, so a querier can resolve the instance from one
+				// response; other questions get the records matching their
+				// name and type.
+				for _, rr := range rrs {
+					if (rr.Name == question.Name && question.Type == rr.Type) ||
+						(question.Type == mdns.TypePTR && question.Name == b.Service.serviceFQDN()) {
+						answers = append(answers, rr)
+					}
+				}
+			}
+			if len(answers) == 0 {
+				continue
+			}
+			resp, err := mdns.NewResponse(answers).Pack()
+			if err != nil {
+				continue
+			}
+			dst := q.src
+			if !unicast {
+				dst = &net.UDPAddr{IP: q.mc.group, Port: q.mc.port}
+			}
+			_, _ = q.mc.npc.WriteTo(resp, dst)
+		}
+	}
+}
+
+// RunAsync runs Run in a new goroutine.
+func (b *MDNSBroadcast) RunAsync(ctx context.Context) {
+	go b.Run(ctx)
+}
+
+// MDNSDiscover discovers instances of a DNS-SD service type, e.g.
+// "_myapp._udp".
+type MDNSDiscover struct {
+	Options     *Options
+	ServiceType string
+	Domain      string
+	*lifecycle
+}
+
+// NewMDNSDiscover creates an MDNSDiscover for serviceType (e.g. "_myapp._udp").
+func NewMDNSDiscover(serviceType string) *MDNSDiscover {
+	return &MDNSDiscover{
+		Options:     &Options{},
+		ServiceType: serviceType,
+		Domain:      "local",
+		lifecycle:   newLifecycle(),
+	}
+}
+
+// Run periodically emits PTR queries for ServiceType on both IPv4 and IPv6
+// and streams resolved instances on the returned channel until ctx is done
+// or Close is called.
+func (d *MDNSDiscover) Run(ctx context.Context) (<-chan *Discovered, error) {
+	initOptions(d.Options)
+
+	conns, err := openMDNSConns(InterfacePolicy{})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := d.merge(ctx)
+
+	out := make(chan *Discovered, 8)
+	serviceName := d.ServiceType + "." + d.Domain + "."
+
+	// wg gates close(out): it must not close until every reader goroutine
+	// below has stopped sending to it, or a resolved instance arriving in
+	// the same instant as shutdown could hit a closed channel (see
+	// Discover.Scan in discovery.go for the same pattern).
+	var wg sync.WaitGroup
+	wg.Add(len(conns))
+	for i := range conns {
+		mc := conns[i]
+		go func() {
+			defer wg.Done()
+			var buf [66507]byte
+			for {
+				n, _, _, err := mc.npc.ReadFrom(buf[:])
+				if err != nil {
+					return
+				}
+				msg, err := mdns.Unpack(buf[:n])
+				if err != nil || !msg.IsResponse() {
+					continue
+				}
+				if disc, ok := parseInstance(msg, serviceName); ok {
+					disc.IPVersion = mc.version
+					select {
+					case out <- disc:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		query, _ := mdns.NewQuery(serviceName, mdns.TypePTR).Pack()
+		ticker := time.NewTicker(d.Options.BroadcastDelay)
+		defer ticker.Stop()
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				break loop
+			case <-ticker.C:
+				for _, mc := range conns {
+					_, _ = mc.npc.WriteTo(query, &net.UDPAddr{IP: mc.group, Port: mc.port})
+				}
+			}
+		}
+		// Closing the conns unblocks any reader goroutine parked in
+		// ReadFrom so it can observe ctx.Done() and return.
+		for _, mc := range conns {
+			mc.Close()
+		}
+		wg.Wait()
+		cancel()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// parseInstance extracts a Discovered entry from a response message, if it
+// answers serviceName with an SRV/TXT/A/AAAA record set.
+func parseInstance(msg *mdns.Message, serviceName string) (*Discovered, bool) {
+	var instance, host string
+	var port int
+	txt := map[string]string{}
+	var addr net.IP
+
+	for _, rr := range msg.Answers {
+		switch rr.Type {
+		case mdns.TypePTR:
+			if rr.Name == serviceName {
+				if name, err := mdns.DecodePTR(rr.Data); err == nil {
+					instance = name
+				}
+			}
+		case mdns.TypeSRV:
+			if !strings.HasSuffix(rr.Name, "."+serviceName) {
+				continue
+			}
+			if srv, err := mdns.DecodeSRV(rr.Data); err == nil {
+				instance = rr.Name
+				host = srv.Target
+				port = int(srv.Port)
+			}
+		case mdns.TypeTXT:
+			if strings.HasSuffix(rr.Name, "."+serviceName) {
+				txt = mdns.DecodeTXT(rr.Data)
+			}
+		case mdns.TypeA:
+			if ip, err := mdns.DecodeA(rr.Data); err == nil {
+				addr = ip
+			}
+		case mdns.TypeAAAA:
+			if ip, err := mdns.DecodeAAAA(rr.Data); err == nil && addr == nil {
+				addr = ip
+			}
+		}
+	}
+
+	if instance == "" || port == 0 {
+		return nil, false
+	}
+
+	d := &Discovered{Host: host, Port: port, TXT: txt}
+	if addr != nil {
+		d.Address = addr.String()
+	}
+	return d, true
+}
@@ -0,0 +1,400 @@
+// Package mdns implements a minimal encoder/decoder for the DNS wire format
+// used by mDNS (RFC 6762) and DNS-SD (RFC 6763). It only supports the record
+// types needed for service discovery: A, AAAA, PTR, SRV and TXT.
+package mdns
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Type is a DNS resource record type.
+type Type uint16
+
+const (
+	TypeA    Type = 1
+	TypePTR  Type = 12
+	TypeTXT  Type = 16
+	TypeAAAA Type = 28
+	TypeSRV  Type = 33
+)
+
+// Class is a DNS resource record class.
+type Class uint16
+
+const ClassINET Class = 1
+
+// classCacheFlushBit marks a resource record as replacing, rather than
+// adding to, the cached set with the same name/type/class (RFC 6762 §10.2).
+const classCacheFlushBit Class = 1 << 15
+
+// classUnicastBit, when set on a question, asks the responder to reply via
+// unicast instead of multicast (RFC 6762 §5.4).
+const classUnicastBit Class = 1 << 15
+
+// Header is the 12-byte DNS message header.
+type Header struct {
+	ID      uint16
+	Flags   uint16
+	QDCount uint16
+	ANCount uint16
+	NSCount uint16
+	ARCount uint16
+}
+
+const (
+	flagResponse   uint16 = 1 << 15
+	flagAuthority  uint16 = 1 << 10
+)
+
+// Question is a DNS question entry.
+type Question struct {
+	Name            string
+	Type            Type
+	Class           Class
+	UnicastResponse bool
+}
+
+// ResourceRecord is a DNS answer/authority/additional record.
+type ResourceRecord struct {
+	Name       string
+	Type       Type
+	Class      Class
+	CacheFlush bool
+	TTL        uint32
+	Data       []byte
+}
+
+// Message is a parsed (or to-be-packed) DNS message.
+type Message struct {
+	Header    Header
+	Questions []Question
+	Answers   []ResourceRecord
+}
+
+// IsResponse reports whether the message is a response (QR bit set).
+func (m *Message) IsResponse() bool {
+	return m.Header.Flags&flagResponse != 0
+}
+
+// NewQuery builds a single-question mDNS query message.
+func NewQuery(name string, t Type) *Message {
+	return &Message{
+		Header: Header{QDCount: 1},
+		Questions: []Question{
+			{Name: name, Type: t, Class: ClassINET},
+		},
+	}
+}
+
+// NewResponse builds an authoritative mDNS response carrying answers.
+func NewResponse(answers []ResourceRecord) *Message {
+	return &Message{
+		Header:  Header{Flags: flagResponse | flagAuthority, ANCount: uint16(len(answers))},
+		Answers: answers,
+	}
+}
+
+// Pack encodes the message into wire format, compressing names where
+// possible as required by RFC 1035 §4.1.4.
+func (m *Message) Pack() ([]byte, error) {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint16(buf[0:2], m.Header.ID)
+	binary.BigEndian.PutUint16(buf[2:4], m.Header.Flags)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(buf[8:10], 0)
+	binary.BigEndian.PutUint16(buf[10:12], 0)
+
+	names := make(map[string]int)
+
+	for _, q := range m.Questions {
+		buf = appendName(buf, names, q.Name)
+		buf = appendUint16(buf, uint16(q.Type))
+		class := q.Class
+		if q.UnicastResponse {
+			class |= classUnicastBit
+		}
+		buf = appendUint16(buf, uint16(class))
+	}
+
+	for _, rr := range m.Answers {
+		buf = appendName(buf, names, rr.Name)
+		buf = appendUint16(buf, uint16(rr.Type))
+		class := rr.Class
+		if rr.CacheFlush {
+			class |= classCacheFlushBit
+		}
+		buf = appendUint16(buf, uint16(class))
+		buf = appendUint32(buf, rr.TTL)
+		buf = appendUint16(buf, uint16(len(rr.Data)))
+		buf = append(buf, rr.Data...)
+	}
+
+	return buf, nil
+}
+
+// Unpack decodes a DNS message from wire format.
+func Unpack(buf []byte) (*Message, error) {
+	if len(buf) < 12 {
+		return nil, fmt.Errorf("mdns: message too short")
+	}
+
+	m := &Message{
+		Header: Header{
+			ID:      binary.BigEndian.Uint16(buf[0:2]),
+			Flags:   binary.BigEndian.Uint16(buf[2:4]),
+			QDCount: binary.BigEndian.Uint16(buf[4:6]),
+			ANCount: binary.BigEndian.Uint16(buf[6:8]),
+			NSCount: binary.BigEndian.Uint16(buf[8:10]),
+			ARCount: binary.BigEndian.Uint16(buf[10:12]),
+		},
+	}
+
+	off := 12
+	for i := 0; i < int(m.Header.QDCount); i++ {
+		name, next, err := readName(buf, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(buf) {
+			return nil, fmt.Errorf("mdns: truncated question")
+		}
+		class := Class(binary.BigEndian.Uint16(buf[next+2 : next+4]))
+		q := Question{
+			Name:            name,
+			Type:            Type(binary.BigEndian.Uint16(buf[next : next+2])),
+			Class:           class &^ classUnicastBit,
+			UnicastResponse: class&classUnicastBit != 0,
+		}
+		m.Questions = append(m.Questions, q)
+		off = next + 4
+	}
+
+	total := int(m.Header.ANCount) + int(m.Header.NSCount) + int(m.Header.ARCount)
+	for i := 0; i < total; i++ {
+		name, next, err := readName(buf, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+10 > len(buf) {
+			return nil, fmt.Errorf("mdns: truncated resource record")
+		}
+		class := Class(binary.BigEndian.Uint16(buf[next+2 : next+4]))
+		rdlen := int(binary.BigEndian.Uint16(buf[next+8 : next+10]))
+		dataStart := next + 10
+		if dataStart+rdlen > len(buf) {
+			return nil, fmt.Errorf("mdns: truncated resource data")
+		}
+		rr := ResourceRecord{
+			Name:       name,
+			Type:       Type(binary.BigEndian.Uint16(buf[next : next+2])),
+			Class:      class &^ classCacheFlushBit,
+			CacheFlush: class&classCacheFlushBit != 0,
+			TTL:        binary.BigEndian.Uint32(buf[next+4 : next+8]),
+			Data:       buf[dataStart : dataStart+rdlen],
+		}
+		m.Answers = append(m.Answers, rr)
+		off = dataStart + rdlen
+	}
+
+	return m, nil
+}
+
+// EncodeA encodes an A record's resource data.
+func EncodeA(ip net.IP) []byte {
+	return []byte(ip.To4())
+}
+
+// EncodeAAAA encodes an AAAA record's resource data.
+func EncodeAAAA(ip net.IP) []byte {
+	return []byte(ip.To16())
+}
+
+// DecodeA decodes an A record's resource data.
+func DecodeA(data []byte) (net.IP, error) {
+	if len(data) != 4 {
+		return nil, fmt.Errorf("mdns: bad A record length %d", len(data))
+	}
+	return net.IP(data), nil
+}
+
+// DecodeAAAA decodes an AAAA record's resource data.
+func DecodeAAAA(data []byte) (net.IP, error) {
+	if len(data) != 16 {
+		return nil, fmt.Errorf("mdns: bad AAAA record length %d", len(data))
+	}
+	return net.IP(data), nil
+}
+
+// EncodePTR encodes a PTR record's resource data (a single domain name).
+func EncodePTR(name string) []byte {
+	return appendName(nil, map[string]int{}, name)
+}
+
+// DecodePTR decodes a PTR record's resource data.
+func DecodePTR(data []byte) (string, error) {
+	name, _, err := readName(data, 0)
+	return name, err
+}
+
+// SRV is the record data of an SRV record (RFC 2782).
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// EncodeSRV encodes an SRV record's resource data.
+func EncodeSRV(srv SRV) []byte {
+	buf := appendUint16(nil, srv.Priority)
+	buf = appendUint16(buf, srv.Weight)
+	buf = appendUint16(buf, srv.Port)
+	return appendName(buf, map[string]int{}, srv.Target)
+}
+
+// DecodeSRV decodes an SRV record's resource data.
+func DecodeSRV(data []byte) (SRV, error) {
+	if len(data) < 6 {
+		return SRV{}, fmt.Errorf("mdns: bad SRV record length %d", len(data))
+	}
+	target, _, err := readName(data, 6)
+	if err != nil {
+		return SRV{}, err
+	}
+	return SRV{
+		Priority: binary.BigEndian.Uint16(data[0:2]),
+		Weight:   binary.BigEndian.Uint16(data[2:4]),
+		Port:     binary.BigEndian.Uint16(data[4:6]),
+		Target:   target,
+	}, nil
+}
+
+// EncodeTXT encodes a TXT record's resource data from key/value pairs.
+func EncodeTXT(kv map[string]string) []byte {
+	var buf []byte
+	for k, v := range kv {
+		entry := k + "=" + v
+		if len(entry) > 255 {
+			entry = entry[:255]
+		}
+		buf = append(buf, byte(len(entry)))
+		buf = append(buf, entry...)
+	}
+	return buf
+}
+
+// DecodeTXT decodes a TXT record's resource data into key/value pairs.
+func DecodeTXT(data []byte) map[string]string {
+	kv := make(map[string]string)
+	for len(data) > 0 {
+		n := int(data[0])
+		data = data[1:]
+		if n > len(data) {
+			break
+		}
+		entry := string(data[:n])
+		data = data[n:]
+		if idx := strings.IndexByte(entry, '='); idx >= 0 {
+			kv[entry[:idx]] = entry[idx+1:]
+		} else if entry != "" {
+			kv[entry] = ""
+		}
+	}
+	return kv
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
+
+// appendName writes name in DNS label format, reusing a previously written
+// suffix via a compression pointer when one is available in names.
+func appendName(buf []byte, names map[string]int, name string) []byte {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return append(buf, 0)
+	}
+
+	if off, ok := names[name]; ok {
+		return appendUint16(buf, uint16(0xC000|off))
+	}
+	if len(buf) < 0x4000 {
+		names[name] = len(buf)
+	}
+
+	labels := strings.Split(name, ".")
+	first := labels[0]
+	buf = append(buf, byte(len(first)))
+	buf = append(buf, first...)
+
+	rest := strings.Join(labels[1:], ".")
+	return appendName(buf, names, rest)
+}
+
+// readName decodes a (possibly compressed) DNS name starting at off and
+// returns the name, along with the offset immediately following it in the
+// original (uncompressed-following) stream.
+func readName(buf []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	cur := off
+	hops := 0
+
+	for {
+		if cur >= len(buf) {
+			return "", 0, fmt.Errorf("mdns: name runs past end of message")
+		}
+		length := int(buf[cur])
+
+		if length == 0 {
+			cur++
+			break
+		}
+
+		if length&0xC0 == 0xC0 {
+			if cur+1 >= len(buf) {
+				return "", 0, fmt.Errorf("mdns: truncated compression pointer")
+			}
+			if end == -1 {
+				end = cur + 2
+			}
+			ptr := int(length&0x3F)<<8 | int(buf[cur+1])
+			cur = ptr
+			hops++
+			if hops > 128 {
+				return "", 0, fmt.Errorf("mdns: compression pointer loop")
+			}
+			continue
+		}
+
+		if length&0xC0 != 0 {
+			return "", 0, fmt.Errorf("mdns: unsupported label length byte")
+		}
+
+		cur++
+		if cur+length > len(buf) {
+			return "", 0, fmt.Errorf("mdns: label runs past end of message")
+		}
+		labels = append(labels, string(buf[cur:cur+length]))
+		cur += length
+	}
+
+	if end == -1 {
+		end = cur
+	}
+	// Every name appendName encodes has had its trailing dot trimmed before
+	// being split into labels, so restore it here to keep decoded names
+	// comparable to the FQDNs built by ServiceInfo/MDNSDiscover, which all
+	// carry one (e.g. "_myapp._udp.local.").
+	return strings.Join(labels, ".") + ".", end, nil
+}
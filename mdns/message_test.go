@@ -0,0 +1,185 @@
+package mdns
+
+import (
+	"net"
+	"testing"
+)
+
+// TestPackUnpackQuery round-trips a single-question query through Pack and
+// Unpack and checks the question survives intact.
+func TestPackUnpackQuery(t *testing.T) {
+	q := NewQuery("_myapp._udp.local.", TypePTR)
+
+	buf, err := q.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	got, err := Unpack(buf)
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if got.IsResponse() {
+		t.Fatal("query unpacked as a response")
+	}
+	if len(got.Questions) != 1 {
+		t.Fatalf("got %d questions, want 1", len(got.Questions))
+	}
+	gq := got.Questions[0]
+	if gq.Name != "_myapp._udp.local." || gq.Type != TypePTR || gq.Class != ClassINET {
+		t.Fatalf("got question %+v, want Name=_myapp._udp.local. Type=PTR Class=INET", gq)
+	}
+	if gq.UnicastResponse {
+		t.Fatal("UnicastResponse set on a query that didn't request it")
+	}
+}
+
+// TestPackUnpackQueryUnicastResponse checks the unicast-response bit
+// round-trips without leaking into the decoded Class.
+func TestPackUnpackQueryUnicastResponse(t *testing.T) {
+	q := NewQuery("my-node._myapp._udp.local.", TypeSRV)
+	q.Questions[0].UnicastResponse = true
+
+	buf, err := q.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	got, err := Unpack(buf)
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if !got.Questions[0].UnicastResponse {
+		t.Fatal("UnicastResponse bit did not survive the round trip")
+	}
+	if got.Questions[0].Class != ClassINET {
+		t.Fatalf("got Class %v, want ClassINET (unicast bit leaked into Class)", got.Questions[0].Class)
+	}
+}
+
+// TestPackUnpackResponseNameCompression builds a response whose answers
+// share a common suffix, so Pack must emit a compression pointer for the
+// repeated names, and checks every answer still decodes to the right name.
+func TestPackUnpackResponseNameCompression(t *testing.T) {
+	const service = "_myapp._udp.local."
+	const instance = "my-node." + service
+
+	rrs := []ResourceRecord{
+		{Name: service, Type: TypePTR, Class: ClassINET, TTL: 120, Data: EncodePTR(instance)},
+		{Name: instance, Type: TypeSRV, Class: ClassINET, CacheFlush: true, TTL: 120,
+			Data: EncodeSRV(SRV{Port: 9081, Target: "my-node.local."})},
+		{Name: instance, Type: TypeTXT, Class: ClassINET, CacheFlush: true, TTL: 120,
+			Data: EncodeTXT(map[string]string{"v": "1"})},
+	}
+
+	buf, err := NewResponse(rrs).Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	got, err := Unpack(buf)
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	if !got.IsResponse() {
+		t.Fatal("response unpacked as a query")
+	}
+	if len(got.Answers) != len(rrs) {
+		t.Fatalf("got %d answers, want %d", len(got.Answers), len(rrs))
+	}
+	for i, want := range rrs {
+		gotRR := got.Answers[i]
+		if gotRR.Name != want.Name || gotRR.Type != want.Type || gotRR.CacheFlush != want.CacheFlush {
+			t.Fatalf("answer %d: got %+v, want Name=%s Type=%v CacheFlush=%v", i, gotRR, want.Name, want.Type, want.CacheFlush)
+		}
+	}
+
+	srv, err := DecodeSRV(got.Answers[1].Data)
+	if err != nil {
+		t.Fatalf("DecodeSRV: %v", err)
+	}
+	if srv.Target != "my-node.local." {
+		t.Fatalf("got SRV target %q, want my-node.local.", srv.Target)
+	}
+}
+
+// TestAppendNameCompression proves a name already written to the message is
+// reused as a 2-byte compression pointer on its next occurrence, rather
+// than being re-encoded in full (RFC 1035 §4.1.4).
+func TestAppendNameCompression(t *testing.T) {
+	names := map[string]int{}
+	buf := appendName(nil, names, "_myapp._udp.local.")
+	full := len(buf)
+
+	buf = appendName(buf, names, "_myapp._udp.local.")
+	if len(buf) != full+2 {
+		t.Fatalf("second append added %d bytes, want 2 (a compression pointer)", len(buf)-full)
+	}
+	if buf[full]&0xC0 != 0xC0 {
+		t.Fatalf("second append did not start with a compression pointer marker: %08b", buf[full])
+	}
+}
+
+// TestReadNameCompressionPointerLoop proves readName (via Unpack) returns an
+// error instead of hanging or panicking on a crafted message whose
+// compression pointers form a cycle.
+func TestReadNameCompressionPointerLoop(t *testing.T) {
+	buf := make([]byte, 12)
+	buf[5] = 1 // QDCount = 1
+
+	// Pointer at offset 12 points back to offset 12, looping forever.
+	buf = append(buf, 0xC0, 0x0C)
+	buf = append(buf, 0, 0) // Type
+	buf = append(buf, 0, 0) // Class
+
+	if _, err := Unpack(buf); err == nil {
+		t.Fatal("Unpack did not error on a compression pointer loop")
+	}
+}
+
+// TestDecodeARecordBadLength checks DecodeA rejects data that isn't exactly
+// 4 bytes rather than silently truncating or panicking.
+func TestDecodeARecordBadLength(t *testing.T) {
+	if _, err := DecodeA([]byte{1, 2, 3}); err == nil {
+		t.Fatal("DecodeA accepted a 3-byte payload")
+	}
+}
+
+// TestEncodeDecodeA round-trips an IPv4 address through EncodeA/DecodeA.
+func TestEncodeDecodeA(t *testing.T) {
+	want := net.ParseIP("192.168.1.42")
+	got, err := DecodeA(EncodeA(want))
+	if err != nil {
+		t.Fatalf("DecodeA: %v", err)
+	}
+	if !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// TestEncodeDecodeAAAA round-trips an IPv6 address through
+// EncodeAAAA/DecodeAAAA.
+func TestEncodeDecodeAAAA(t *testing.T) {
+	want := net.ParseIP("fe80::1")
+	got, err := DecodeAAAA(EncodeAAAA(want))
+	if err != nil {
+		t.Fatalf("DecodeAAAA: %v", err)
+	}
+	if !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// TestEncodeDecodeTXT round-trips a key/value map through
+// EncodeTXT/DecodeTXT.
+func TestEncodeDecodeTXT(t *testing.T) {
+	want := map[string]string{"v": "1", "role": "leader"}
+	got := DecodeTXT(EncodeTXT(want))
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
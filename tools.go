@@ -1,8 +1,90 @@
 package discovery
 
-import "net"
+import (
+	"net"
+	"regexp"
+	"sort"
+)
 
-func FilterInterfaces(ipv4 bool) (ifaces []*net.Interface, err error) {
+// InterfacePolicy selects and orders the interfaces FilterInterfaces
+// considers. The zero value matches every up, broadcast-capable interface,
+// which is the historical FilterInterfaces behavior.
+type InterfacePolicy struct {
+	// Include, if non-empty, restricts matches to interfaces whose name
+	// equals or matches (as a regexp) one of these entries.
+	Include []string
+	// Exclude drops interfaces whose name equals or matches (as a regexp)
+	// one of these entries, even if Include also matched them.
+	Exclude []string
+	// RequireMulticast additionally requires net.FlagMulticast.
+	RequireMulticast bool
+	// SkipLoopback drops loopback interfaces.
+	SkipLoopback bool
+	// SkipPointToPoint drops point-to-point interfaces (common for VPN
+	// tunnels, which are rarely useful for LAN discovery).
+	SkipPointToPoint bool
+	// Preferred orders matching interfaces with these names first, in the
+	// given order; any interface not listed keeps its relative order after
+	// them.
+	Preferred []string
+	// MinMTU, if non-zero, drops interfaces with a smaller MTU.
+	MinMTU int
+}
+
+// matchesInterfaceName reports whether name equals, or matches as a regexp, pattern.
+func matchesInterfaceName(pattern, name string) bool {
+	if pattern == name {
+		return true
+	}
+	re, err := regexp.Compile(pattern)
+	return err == nil && re.MatchString(name)
+}
+
+// allows reports whether name passes the Include/Exclude lists.
+func (p InterfacePolicy) allows(name string) bool {
+	if len(p.Include) > 0 {
+		included := false
+		for _, pattern := range p.Include {
+			if matchesInterfaceName(pattern, name) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, pattern := range p.Exclude {
+		if matchesInterfaceName(pattern, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// order sorts ifaces so that those named in Preferred come first, in the
+// order given, leaving the rest in their original relative order.
+func (p InterfacePolicy) order(ifaces []*net.Interface) {
+	if len(p.Preferred) == 0 {
+		return
+	}
+	rank := func(name string) int {
+		for i, preferred := range p.Preferred {
+			if preferred == name {
+				return i
+			}
+		}
+		return len(p.Preferred)
+	}
+	sort.SliceStable(ifaces, func(i, j int) bool {
+		return rank(ifaces[i].Name) < rank(ifaces[j].Name)
+	})
+}
+
+// FilterInterfaces returns the interfaces that carry an address in at least
+// one of the requested families (versions may be IPv4, IPv6 or DualStack)
+// and satisfy policy.
+func FilterInterfaces(versions IPVersion, policy InterfacePolicy) (ifaces []*net.Interface, err error) {
 	allIfaces, err := net.Interfaces()
 	if err != nil {
 		return
@@ -14,6 +96,22 @@ func FilterInterfaces(ipv4 bool) (ifaces []*net.Interface, err error) {
 			// interface is down or does not support broadcasting
 			continue
 		}
+		if policy.RequireMulticast && iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if policy.SkipLoopback && iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if policy.SkipPointToPoint && iface.Flags&net.FlagPointToPoint != 0 {
+			continue
+		}
+		if policy.MinMTU > 0 && iface.MTU < policy.MinMTU {
+			continue
+		}
+		if !policy.allows(iface.Name) {
+			continue
+		}
+
 		addrs, _ := iface.Addrs()
 		supported := false
 		for j := range addrs {
@@ -22,8 +120,8 @@ func FilterInterfaces(ipv4 bool) (ifaces []*net.Interface, err error) {
 				continue
 			}
 			isv4 := addr.IP.To4() != nil
-			if isv4 == ipv4 {
-				// IP family matches, go on and use interface
+			if (isv4 && versions&IPv4 != 0) || (!isv4 && versions&IPv6 != 0) {
+				// IP family matches one of the requested families
 				supported = true
 				break
 			}
@@ -32,6 +130,7 @@ func FilterInterfaces(ipv4 bool) (ifaces []*net.Interface, err error) {
 			ifaces = append(ifaces, &iface)
 		}
 	}
+	policy.order(ifaces)
 	return
 }
 